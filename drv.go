@@ -246,8 +246,8 @@ func (n *Number) Scan(v interface{}) error {
 	return nil
 }
 
-// Log function
-var Log = func(...interface{}) error { return nil }
+// Log function. Safe to call concurrently with SetLogger; see log.go.
+var Log = logCall
 
 func init() {
 	d, err := newDrv()
@@ -285,7 +285,7 @@ func (d *drv) Open(connString string) (driver.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn, err := d.openConn(P)
+	conn, err := d.openConn(context.Background(), P)
 	return conn, maybeBadConn(err)
 }
 
@@ -301,7 +301,7 @@ func (d *drv) ClientVersion() (VersionInfo, error) {
 	return d.clientVersion, nil
 }
 
-func (d *drv) openConn(P ConnectionParams) (*conn, error) {
+func (d *drv) openConn(ctx context.Context, P ConnectionParams) (*conn, error) {
 	c := conn{drv: d, connParams: P}
 	connString := P.StringNoClass()
 
@@ -326,41 +326,86 @@ func (d *drv) openConn(P ConnectionParams) (*conn, error) {
 		connCreateParams.connectionClass = cConnClass
 		connCreateParams.connectionClassLength = C.uint32_t(len(P.ConnClass))
 	}
+	if P.Tag != "" {
+		cTag := C.CString(P.Tag)
+		defer C.free(unsafe.Pointer(cTag))
+		connCreateParams.tag = cTag
+		connCreateParams.tagLength = C.uint32_t(len(P.Tag))
+		connCreateParams.matchAnyTag = 0
+	}
+
+	// Compute the effective (possibly proxy, "user[proxy_user]") username
+	// up front: a heterogeneous pool (see homogeneous=0 below) needs these
+	// credentials on *every* acquireConnection call, not just the one that
+	// creates the pool.
+	authUsername := P.authUsername()
+	var cAuthUserName, cAuthPassword *C.char
+	if !(authUsername == "" && P.Password == "") {
+		cAuthUserName, cAuthPassword = C.CString(authUsername), C.CString(P.Password)
+		defer C.free(unsafe.Pointer(cAuthUserName))
+		defer C.free(unsafe.Pointer(cAuthPassword))
+	}
+
 	if !(P.IsSysDBA || P.IsSysOper) {
 		d.poolsMu.Lock()
 		dp := d.pools[connString]
 		d.poolsMu.Unlock()
 		if dp != nil {
 			dc := C.malloc(C.sizeof_void)
-			Log("C", "dpiPool_acquireConnection", "conn", connCreateParams)
-			if C.dpiPool_acquireConnection(
+			Log("C", "dpiPool_acquireConnection", "username", authUsername, "conn", connCreateParams)
+			rc := C.dpiPool_acquireConnection(
 				dp,
-				nil, 0, nil, 0, &connCreateParams,
+				cAuthUserName, C.uint32_t(len(authUsername)), cAuthPassword, C.uint32_t(len(P.Password)), &connCreateParams,
 				(**C.dpiConn)(unsafe.Pointer(&dc)),
-			) == C.DPI_FAILURE {
-				return nil, errors.Wrapf(d.getError(), "acquireConnection[%s]", P)
+			)
+			var acquireErr error
+			if rc == C.DPI_FAILURE {
+				acquireErr = errors.Wrapf(d.getError(), "acquireConnection[%s]", P)
+			}
+			traceRoundTrip(ctx, "dpiPool_acquireConnection", acquireErr)
+			if acquireErr != nil {
+				return nil, acquireErr
 			}
 			c.dpiConn = (*C.dpiConn)(dc)
+			if Pool.OnAcquire != nil {
+				Pool.OnAcquire(connString, fmt.Sprintf("%p", dc))
+			}
+			if err := c.runSessionInit(ctx, connCreateParams.outTagFound == 0); err != nil {
+				return nil, err
+			}
 			return &c, nil
 		}
 	}
 
-	var cUserName, cPassword *C.char
-	if !(P.Username == "" && P.Password == "") {
-		cUserName, cPassword = C.CString(P.Username), C.CString(P.Password)
-	}
+	cUserName, cPassword := cAuthUserName, cAuthPassword
 	cSid := C.CString(P.SID)
 	cUTF8, cConnClass := C.CString("AL32UTF8"), C.CString(P.ConnClass)
 	cDriverName := C.CString(DriverName)
+	var cConfigDir, cWalletLocation, cWalletPassword *C.char
+	if P.ConfigDir != "" {
+		cConfigDir = C.CString(P.ConfigDir)
+	}
+	if P.WalletLocation != "" {
+		cWalletLocation = C.CString(P.WalletLocation)
+	}
+	if P.WalletPassword != "" {
+		cWalletPassword = C.CString(P.WalletPassword)
+	}
 	defer func() {
-		if cUserName != nil {
-			C.free(unsafe.Pointer(cUserName))
-			C.free(unsafe.Pointer(cPassword))
-		}
+		// cUserName/cPassword alias cAuthUserName/cAuthPassword, freed above.
 		C.free(unsafe.Pointer(cSid))
 		C.free(unsafe.Pointer(cUTF8))
 		C.free(unsafe.Pointer(cConnClass))
 		C.free(unsafe.Pointer(cDriverName))
+		if cConfigDir != nil {
+			C.free(unsafe.Pointer(cConfigDir))
+		}
+		if cWalletLocation != nil {
+			C.free(unsafe.Pointer(cWalletLocation))
+		}
+		if cWalletPassword != nil {
+			C.free(unsafe.Pointer(cWalletPassword))
+		}
 	}()
 	var commonCreateParams C.dpiCommonCreateParams
 	if C.dpiContext_initCommonCreateParams(d.dpiContext, &commonCreateParams) == C.DPI_FAILURE {
@@ -371,22 +416,46 @@ func (d *drv) openConn(P ConnectionParams) (*conn, error) {
 	commonCreateParams.nencoding = cUTF8
 	commonCreateParams.driverName = cDriverName
 	commonCreateParams.driverNameLength = C.uint32_t(len(DriverName))
+	// configDir/walletLocation/walletPassword locate an Oracle Cloud wallet
+	// (cwallet.sso/ewallet.p12) for TLS/mTLS connections, e.g. to Autonomous
+	// Database, without requiring an external tnsnames.ora/TNS_ADMIN.
+	if cConfigDir != nil {
+		commonCreateParams.configDir = cConfigDir
+		commonCreateParams.configDirLength = C.uint32_t(len(P.ConfigDir))
+	}
+	if cWalletLocation != nil {
+		commonCreateParams.walletLocation = cWalletLocation
+		commonCreateParams.walletLocationLength = C.uint32_t(len(P.WalletLocation))
+	}
+	if cWalletPassword != nil {
+		commonCreateParams.walletPassword = cWalletPassword
+		commonCreateParams.walletPasswordLength = C.uint32_t(len(P.WalletPassword))
+	}
 
 	if P.IsSysDBA || P.IsSysOper {
 		dc := C.malloc(C.sizeof_void)
-		Log("C", "dpiConn_create", "username", P.Username, "password", P.Password, "sid", P.SID, "common", commonCreateParams, "conn", connCreateParams)
-		if C.dpiConn_create(
+		Log("C", "dpiConn_create", "username", authUsername, "password", P.Password, "sid", P.SID, "common", commonCreateParams, "conn", connCreateParams)
+		rc := C.dpiConn_create(
 			d.dpiContext,
-			cUserName, C.uint32_t(len(P.Username)),
+			cUserName, C.uint32_t(len(authUsername)),
 			cPassword, C.uint32_t(len(P.Password)),
 			cSid, C.uint32_t(len(P.SID)),
 			&commonCreateParams,
 			&connCreateParams,
 			(**C.dpiConn)(unsafe.Pointer(&dc)),
-		) == C.DPI_FAILURE {
-			return nil, errors.Wrapf(d.getError(), "username=%q password=%q sid=%q params=%+v", P.Username, P.Password, P.SID, connCreateParams)
+		)
+		var createErr error
+		if rc == C.DPI_FAILURE {
+			createErr = errors.Wrapf(d.getError(), "username=%q password=%q sid=%q params=%+v", authUsername, P.Password, P.SID, connCreateParams)
+		}
+		traceRoundTrip(ctx, "dpiConn_create", createErr)
+		if createErr != nil {
+			return nil, createErr
 		}
 		c.dpiConn = (*C.dpiConn)(dc)
+		if err := c.runSessionInit(ctx, true); err != nil {
+			return nil, err
+		}
 		return &c, nil
 	}
 	var poolCreateParams C.dpiPoolCreateParams
@@ -396,27 +465,35 @@ func (d *drv) openConn(P ConnectionParams) (*conn, error) {
 	poolCreateParams.minSessions = C.uint32_t(P.MinSessions)
 	poolCreateParams.maxSessions = C.uint32_t(P.MaxSessions)
 	poolCreateParams.sessionIncrement = C.uint32_t(P.PoolIncrement)
-	if extAuth == 1 {
+	if extAuth == 1 || P.ProxyUsername != "" {
+		// Heterogeneous: each acquireConnection call may present its own
+		// credentials (e.g. proxy auth) against the shared wallet/pool.
 		poolCreateParams.homogeneous = 0
 	}
 	poolCreateParams.externalAuth = extAuth
 	poolCreateParams.getMode = C.DPI_MODE_POOL_GET_NOWAIT
 
 	var dp *C.dpiPool
-	Log("C", "dpiPool_create", "username", P.Username, "password", P.Password, "sid", P.SID, "common", commonCreateParams, "pool", poolCreateParams)
-	if C.dpiPool_create(
+	Log("C", "dpiPool_create", "username", authUsername, "password", P.Password, "sid", P.SID, "common", commonCreateParams, "pool", poolCreateParams)
+	rc := C.dpiPool_create(
 		d.dpiContext,
-		cUserName, C.uint32_t(len(P.Username)),
+		cUserName, C.uint32_t(len(authUsername)),
 		cPassword, C.uint32_t(len(P.Password)),
 		cSid, C.uint32_t(len(P.SID)),
 		&commonCreateParams,
 		&poolCreateParams,
 		(**C.dpiPool)(unsafe.Pointer(&dp)),
-	) == C.DPI_FAILURE {
-		return nil, errors.Wrapf(d.getError(), "username=%q password=%q minSessions=%d maxSessions=%d poolIncrement=%d extAuth=%d",
-			P.Username, strings.Repeat("*", len(P.Password)),
+	)
+	var createErr error
+	if rc == C.DPI_FAILURE {
+		createErr = errors.Wrapf(d.getError(), "username=%q password=%q minSessions=%d maxSessions=%d poolIncrement=%d extAuth=%d",
+			authUsername, strings.Repeat("*", len(P.Password)),
 			P.MinSessions, P.MaxSessions, P.PoolIncrement, extAuth)
 	}
+	traceRoundTrip(ctx, "dpiPool_create", createErr)
+	if createErr != nil {
+		return nil, createErr
+	}
 	C.dpiPool_setTimeout(dp, 300)
 	//C.dpiPool_setMaxLifetimeSession(dp, 3600)
 	C.dpiPool_setStmtCacheSize(dp, 1<<20)
@@ -424,7 +501,7 @@ func (d *drv) openConn(P ConnectionParams) (*conn, error) {
 	d.pools[connString] = dp
 	d.poolsMu.Unlock()
 
-	return d.openConn(P)
+	return d.openConn(ctx, P)
 }
 
 // ConnectionParams holds the params for a connection (pool).
@@ -434,6 +511,40 @@ type ConnectionParams struct {
 	Username, Password, SID, ConnClass      string
 	IsSysDBA, IsSysOper                     bool
 	MinSessions, MaxSessions, PoolIncrement int
+	// Tag is the DRCP/session pool tag to acquire a session with (see ContextWithSessionTag).
+	Tag string
+	// SessionInitFunc, if given, is run on a freshly created session, or
+	// whenever the tag requested via Tag wasn't matched by the acquired
+	// session (connCreateParams.outTagFound == 0). It is the place to issue
+	// ALTER SESSION statements (NLS settings, edition, module/action/client
+	// identifier, ...) so pooled/DRCP sessions come back to a known state.
+	SessionInitFunc func(context.Context, driver.Conn) error
+	// ProxyUsername, if non-empty, requests N-tier proxy authentication
+	// ("user[proxy_user]/pwd@db"): Username connects as ProxyUsername.
+	ProxyUsername string
+	// ConfigDir is the directory holding tnsnames.ora/sqlnet.ora (TNS_ADMIN).
+	ConfigDir string
+	// WalletLocation and WalletPassword configure an Oracle Cloud wallet
+	// (cwallet.sso/ewallet.p12) for TLS/mTLS connections, e.g. to ADB.
+	WalletLocation, WalletPassword string
+}
+
+// authUsername returns the username as it should be passed to OCI, including
+// the "user[proxy_user]" bracket form used for N-tier proxy authentication.
+func (P ConnectionParams) authUsername() string {
+	if P.ProxyUsername == "" {
+		return P.Username
+	}
+	return P.Username + "[" + P.ProxyUsername + "]"
+}
+
+// splitProxyUsername splits the "user[proxy_user]" bracket form used for
+// N-tier proxy authentication into its two parts.
+func splitProxyUsername(username string) (user, proxy string) {
+	if i := strings.IndexByte(username, '['); i >= 0 && strings.HasSuffix(username, "]") {
+		return username[:i], username[i+1 : len(username)-1]
+	}
+	return username, ""
 }
 
 func (P ConnectionParams) StringNoClass() string {
@@ -481,6 +592,7 @@ func ParseConnString(connString string) (ConnectionParams, error) {
 			return P, errors.Errorf("no / in %q", connString)
 		}
 		P.Username, connString = connString[:i], connString[i+1:]
+		P.Username, P.ProxyUsername = splitProxyUsername(P.Username)
 		if i = strings.IndexByte(connString, '@'); i >= 0 {
 			P.Password, P.SID = connString[:i], connString[i+1:]
 		} else {
@@ -498,6 +610,7 @@ func ParseConnString(connString string) (ConnectionParams, error) {
 		if strings.HasSuffix(P.SID, ":POOLED") {
 			P.ConnClass, P.SID = "POOLED", P.SID[:len(P.SID)-7]
 		}
+		P.ConfigDir = os.Getenv("TNS_ADMIN")
 		return P, nil
 	}
 	u, err := url.Parse(connString)
@@ -506,6 +619,7 @@ func ParseConnString(connString string) (ConnectionParams, error) {
 	}
 	if usr := u.User; usr != nil {
 		P.Username = usr.Username()
+		P.Username, P.ProxyUsername = splitProxyUsername(P.Username)
 		P.Password, _ = usr.Password()
 	}
 	P.SID = u.Hostname()
@@ -522,6 +636,12 @@ func ParseConnString(connString string) (ConnectionParams, error) {
 	if P.IsSysDBA = q.Get("sysdba") == "1"; !P.IsSysDBA {
 		P.IsSysOper = q.Get("sysoper") == "1"
 	}
+	P.ConfigDir = q.Get("TNS_ADMIN")
+	if P.ConfigDir == "" {
+		P.ConfigDir = os.Getenv("TNS_ADMIN")
+	}
+	P.WalletLocation = q.Get("walletLocation")
+	P.WalletPassword = q.Get("walletPassword")
 
 	for _, task := range []struct {
 		Dest *int
@@ -0,0 +1,125 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package goracle
+
+/*
+#include <stdlib.h>
+
+#include "dpiImpl.h"
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql/driver"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const sessionTagCtxKey = ctxKey("goracle.SessionTag")
+
+// ContextWithSessionTag returns a context that, when used to acquire a
+// connection through a Connector obtained from drv.OpenConnector, requests
+// the given DRCP/session pool tag (ConnectionParams.Tag).
+func ContextWithSessionTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, sessionTagCtxKey, tag)
+}
+
+func sessionTagFromContext(ctx context.Context) string {
+	tag, _ := ctx.Value(sessionTagCtxKey).(string)
+	return tag
+}
+
+// connector implements driver.Connector, honoring the session tag stashed in
+// the context given to Connect by ContextWithSessionTag.
+type connector struct {
+	drv    *drv
+	params ConnectionParams
+}
+
+// OpenConnector returns a driver.Connector for name, so callers can use
+// ContextWithSessionTag with (*sql.DB).Conn(ctx) / sql.OpenDB to request a
+// specific DRCP/session pool tag per checkout.
+func (d *drv) OpenConnector(name string) (driver.Connector, error) {
+	P, err := ParseConnString(name)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{drv: d, params: P}, nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	P := c.params
+	P.Tag = sessionTagFromContext(ctx)
+	conn, err := c.drv.openConn(ctx, P)
+	return conn, maybeBadConn(err)
+}
+
+func (c *connector) Driver() driver.Driver { return c.drv }
+
+// runSessionInit calls connParams.SessionInitFunc, if set, whenever fresh
+// reports a newly created session or a tag mismatch (ODPI-C's outTagFound
+// coming back false), so pooled/DRCP sessions are brought back to a known
+// NLS/module/action state before being handed to the application. ctx is the
+// caller's context (from Connector.Connect, or context.Background() when
+// opened through the ctx-less driver.Driver.Open), so a SessionInitFunc that
+// honors cancellation/deadlines sees the real one.
+func (c *conn) runSessionInit(ctx context.Context, fresh bool) error {
+	if !fresh || c.connParams.SessionInitFunc == nil {
+		return nil
+	}
+	return c.connParams.SessionInitFunc(ctx, c)
+}
+
+// EndToEndMetrics holds the OCI end-to-end tracing attributes that can be
+// set on a session with Conn.SetEndToEndMetrics.
+type EndToEndMetrics struct {
+	Module           string
+	Action           string
+	ClientIdentifier string
+	ClientInfo       string
+	DbOp             string
+}
+
+// SetEndToEndMetrics sets the OCI end-to-end tracing attributes on the
+// session, visible in V$SESSION and AWR/ASH reports. Fields left at their
+// zero value are left untouched, so a partial update (e.g.
+// EndToEndMetrics{Action: "checkout"}) doesn't blank out attributes set by
+// an earlier call or by SessionInitFunc.
+func (c *conn) SetEndToEndMetrics(m EndToEndMetrics) error {
+	for _, kv := range []struct {
+		value string
+		set   func(*C.dpiConn, *C.char, C.uint32_t) C.int
+	}{
+		{m.Module, func(dc *C.dpiConn, s *C.char, n C.uint32_t) C.int { return C.dpiConn_setModule(dc, s, n) }},
+		{m.Action, func(dc *C.dpiConn, s *C.char, n C.uint32_t) C.int { return C.dpiConn_setAction(dc, s, n) }},
+		{m.ClientIdentifier, func(dc *C.dpiConn, s *C.char, n C.uint32_t) C.int { return C.dpiConn_setClientIdentifier(dc, s, n) }},
+		{m.ClientInfo, func(dc *C.dpiConn, s *C.char, n C.uint32_t) C.int { return C.dpiConn_setClientInfo(dc, s, n) }},
+		{m.DbOp, func(dc *C.dpiConn, s *C.char, n C.uint32_t) C.int { return C.dpiConn_setDbOp(dc, s, n) }},
+	} {
+		if kv.value == "" {
+			continue
+		}
+		cValue := C.CString(kv.value)
+		rc := kv.set(c.dpiConn, cValue, C.uint32_t(len(kv.value)))
+		C.free(unsafe.Pointer(cValue))
+		if rc == C.DPI_FAILURE {
+			return errors.Wrap(c.drv.getError(), "setEndToEndMetrics")
+		}
+	}
+	return nil
+}
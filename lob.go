@@ -0,0 +1,296 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package goracle
+
+/*
+#include <stdlib.h>
+
+#include "dpiImpl.h"
+*/
+import "C"
+
+import (
+	"context"
+	"io"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// OracleType of the underlying LOB (CLOB, NCLOB, BLOB or BFILE).
+type OracleType int
+
+const (
+	CLOB  = OracleType(C.DPI_ORACLE_TYPE_CLOB)
+	NCLOB = OracleType(C.DPI_ORACLE_TYPE_NCLOB)
+	BLOB  = OracleType(C.DPI_ORACLE_TYPE_BLOB)
+	BFILE = OracleType(C.DPI_ORACLE_TYPE_BFILE)
+)
+
+// Lob is a handle to an Oracle LOB, readable/writable in chunks without
+// materializing the whole value in memory.
+//
+// Obtain one from a column scan (see DirectLob/ContextWithLobAsReader) or
+// create a temporary one with NewTempLob for use as a bind parameter.
+type Lob struct {
+	conn      *conn
+	dpiLob    *C.dpiLob
+	typ       OracleType
+	chunkSize uint32
+}
+
+// NewTempLob creates a temporary LOB of typ on conn, suitable for streaming
+// a large bind parameter without holding the whole payload in Go memory.
+func (c *conn) NewTempLob(typ OracleType) (*Lob, error) {
+	var dl *C.dpiLob
+	if C.dpiConn_newTempLob(c.dpiConn, C.dpiOracleTypeNum(typ), &dl) == C.DPI_FAILURE {
+		return nil, errors.Wrap(c.drv.getError(), "newTempLob")
+	}
+	l := &Lob{conn: c, dpiLob: dl, typ: typ}
+	if err := l.loadChunkSize(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Lob) loadChunkSize() error {
+	var cs C.uint32_t
+	if C.dpiLob_getChunkSize(l.dpiLob, &cs) == C.DPI_FAILURE {
+		return errors.Wrap(l.conn.drv.getError(), "getChunkSize")
+	}
+	l.chunkSize = uint32(cs)
+	return nil
+}
+
+// Size returns the current length of the LOB, in characters for CLOB/NCLOB
+// or bytes for BLOB/BFILE.
+func (l *Lob) Size() (int64, error) {
+	var n C.uint64_t
+	if C.dpiLob_getSize(l.dpiLob, &n) == C.DPI_FAILURE {
+		return 0, errors.Wrap(l.conn.drv.getError(), "getSize")
+	}
+	return int64(n), nil
+}
+
+// Truncate trims the LOB to n characters/bytes (dpiLob_trim); it does not
+// extend a LOB shorter than n.
+func (l *Lob) Truncate(n int64) error {
+	if C.dpiLob_trim(l.dpiLob, C.uint64_t(n)) == C.DPI_FAILURE {
+		return errors.Wrap(l.conn.drv.getError(), "trim")
+	}
+	return nil
+}
+
+// Close releases the underlying dpiLob handle.
+func (l *Lob) Close() error {
+	if l.dpiLob == nil {
+		return nil
+	}
+	dl := l.dpiLob
+	l.dpiLob = nil
+	if C.dpiLob_close(dl) == C.DPI_FAILURE {
+		return errors.Wrap(l.conn.drv.getError(), "close")
+	}
+	return nil
+}
+
+// defaultChunkSize is used when the LOB's own ChunkSize could not be
+// determined (zero), so reads/writes still happen in bounded pieces.
+const defaultChunkSize = 8192
+
+// NewReader returns an io.ReadSeekCloser over the LOB contents. Regardless of
+// the size of the buffer passed to Read, each underlying dpiLob_readBytes
+// call is capped at l.chunkSize bytes/characters, so a single large Read
+// doesn't turn into one oversized network round trip.
+func (l *Lob) NewReader() io.ReadSeekCloser {
+	return &lobReader{Lob: l}
+}
+
+// NewWriter returns an io.WriteCloser that writes the LOB from its start,
+// overwriting any existing content. Writes are
+// buffered and flushed to dpiLob_writeBytes in l.chunkSize-sized pieces;
+// Close flushes any remainder.
+func (l *Lob) NewWriter() io.WriteCloser {
+	return &lobWriter{Lob: l}
+}
+
+type lobReader struct {
+	*Lob
+	pos int64  // 0-based, in characters (CLOB/NCLOB) or bytes (BLOB/BFILE)
+	buf []byte // bytes already fetched from the LOB but not yet returned
+}
+
+func (r *lobReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill reads up to one ChunkSize-sized piece from the LOB into r.buf.
+func (r *lobReader) fill() error {
+	size, err := r.Size()
+	if err != nil {
+		return err
+	}
+	if r.pos >= size {
+		return nil // caller sees io.EOF from the empty buffer
+	}
+	want := int64(r.chunkSize)
+	if want <= 0 {
+		want = defaultChunkSize
+	}
+	if max := size - r.pos; want > max {
+		want = max
+	}
+	// want (like size/pos) is a character count for CLOB/NCLOB, but the
+	// buffer dpiLob_readBytes writes into is sized in bytes: AL32UTF8 and
+	// other multi-byte charsets can take up to 4 bytes per character, so a
+	// byte-for-character buffer truncates non-ASCII content. BLOB/BFILE are
+	// already byte-denominated, so want and the buffer size coincide there.
+	bufSize := want
+	if r.typ == CLOB || r.typ == NCLOB {
+		bufSize = want * 4
+	}
+	buf := make([]byte, bufSize)
+	n := C.uint64_t(bufSize)
+	if C.dpiLob_readBytes(r.dpiLob, C.uint64_t(r.pos+1), C.uint64_t(want), (*C.char)(unsafe.Pointer(&buf[0])), &n) == C.DPI_FAILURE {
+		return errors.Wrap(r.conn.drv.getError(), "readBytes")
+	}
+	r.buf = buf[:n]
+	r.pos += want
+	return nil
+}
+
+func (r *lobReader) Seek(offset int64, whence int) (int64, error) {
+	size, err := r.Size()
+	if err != nil {
+		return 0, err
+	}
+	newPos := r.pos
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos += offset
+	case io.SeekEnd:
+		newPos = size + offset
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, errors.Errorf("negative position %d", newPos)
+	}
+	r.pos = newPos
+	r.buf = nil // seeking invalidates whatever lookahead fill had buffered
+	return r.pos, nil
+}
+
+func (r *lobReader) Close() error { return nil }
+
+type lobWriter struct {
+	*Lob
+	pos int64
+	buf []byte // pending bytes not yet flushed to the LOB
+}
+
+func (w *lobWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunkSize := int(w.chunkSize)
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= chunkSize {
+		if err := w.flush(w.buf[:chunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[chunkSize:]
+	}
+	return len(p), nil
+}
+
+func (w *lobWriter) flush(chunk []byte) error {
+	if C.dpiLob_writeBytes(w.dpiLob, C.uint64_t(w.pos+1), (*C.char)(unsafe.Pointer(&chunk[0])), C.uint64_t(len(chunk))) == C.DPI_FAILURE {
+		return errors.Wrap(w.conn.drv.getError(), "writeBytes")
+	}
+	w.pos += int64(len(chunk))
+	return nil
+}
+
+// Close flushes any buffered bytes smaller than a full chunk.
+func (w *lobWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.flush(w.buf)
+	w.buf = nil
+	return err
+}
+
+type lobCtxKey string
+
+const lobAsReaderCtxKey = lobCtxKey("goracle.LobAsReader")
+
+// ContextWithLobAsReader marks ctx so that DirectLob(ctx) reports true,
+// mirroring ContextWithFetchRowCount/ContextWithArraySize.
+//
+// Nothing in this package reads the mark: Stmt.Query/Exec column scans are
+// not changed by it and return LOB columns as []byte/string. DirectLob and
+// LobFromData are the pieces a column-scan loop can use to return *Lob
+// instead.
+func ContextWithLobAsReader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lobAsReaderCtxKey, true)
+}
+
+// DirectLob reports whether ctx was marked with ContextWithLobAsReader.
+// Nothing in this package calls DirectLob.
+func DirectLob(ctx context.Context) bool {
+	v, _ := ctx.Value(lobAsReaderCtxKey).(bool)
+	return v
+}
+
+// LobFromData wraps the LOB held in data (a dpiData value fetched with
+// native type DPI_NATIVE_TYPE_LOB) as a *Lob, for a column-scan path to
+// return in place of []byte/string when DirectLob(ctx) is true. typ is the
+// column's LOB type (CLOB, NCLOB, BLOB or BFILE). Returns nil if data
+// represents a SQL NULL.
+func (c *conn) LobFromData(data *C.dpiData, typ OracleType) (*Lob, error) {
+	if data == nil || data.isNull == 1 {
+		return nil, nil
+	}
+	dl := C.dpiData_getLOB(data)
+	if dl == nil {
+		return nil, errors.New("column is not a LOB")
+	}
+	l := &Lob{conn: c, dpiLob: dl, typ: typ}
+	if err := l.loadChunkSize(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package goracle
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Logger is the structured logging interface used by the driver.
+//
+// Log is called with an alternating sequence of keys and values, the same
+// convention the package-level Log func(...interface{}) error has always
+// used (e.g. Log("msg", "acquireConnection", "conn", P)).
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+type logFuncLogger logFunc
+
+func (f logFuncLogger) Log(keyvals ...interface{}) error { return f(keyvals...) }
+
+// loggerValue holds the currently installed Logger's Log method (a
+// func(...interface{}) error), behind an atomic.Value so SetLogger can race
+// freely against the Log(...) calls every DB operation makes.
+var loggerValue atomic.Value
+
+// logCall backs the package-level Log var: it loads the active logger and
+// invokes it, falling back to a no-op before the first SetLogger call.
+func logCall(keyvals ...interface{}) error {
+	f, _ := loggerValue.Load().(func(...interface{}) error)
+	if f == nil {
+		return nil
+	}
+	return f(keyvals...)
+}
+
+// SetLogger installs logger as the driver-wide Logger.
+//
+// For backward compatibility, this also rebinds the package-level Log
+// variable's behavior to logger.Log, so existing code calling Log(...)
+// directly keeps working unchanged. It is safe to call SetLogger
+// concurrently with Log(...) calls made by in-flight DB operations.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		loggerValue.Store(func(...interface{}) error { return nil })
+		return
+	}
+	loggerValue.Store(logger.Log)
+}
+
+// NewSlogLogger adapts sl to the Logger interface expected by SetLogger,
+// logging each call as a single slog record whose attributes are the
+// alternating key/value pairs; a leading "msg" pair, if present, becomes the
+// record's message instead of an attribute.
+func NewSlogLogger(sl *slog.Logger) Logger {
+	return slogLogger{sl: sl}
+}
+
+type slogLogger struct{ sl *slog.Logger }
+
+func (l slogLogger) Log(keyvals ...interface{}) error {
+	if len(keyvals) == 0 {
+		return nil
+	}
+	var msg string
+	if len(keyvals) >= 2 && keyvals[0] == "msg" {
+		msg, keyvals = fmt.Sprint(keyvals[1]), keyvals[2:]
+	}
+	l.sl.Info(msg, keyvals...)
+	return nil
+}
+
+// StmtHooks are statement tracing hooks, for tracing/observability.
+//
+// They are invoked by TraceStmt only. Nothing in this package calls
+// TraceStmt, so OnStmtStart/OnStmtEnd fire only for callers that wrap their
+// own statement calls with TraceStmt.
+type StmtHooks struct {
+	// OnStmtStart is called before a statement is executed.
+	OnStmtStart func(ctx context.Context, query string, args []driver.NamedValue)
+	// OnStmtEnd is called after a statement finished executing or fetching,
+	// with err nil on success and rows the number of rows affected/fetched.
+	OnStmtEnd func(ctx context.Context, query string, err error, rows int64)
+}
+
+// PoolHooks are fired around session pool/DRCP checkout and checkin.
+//
+// OnAcquire fires from drv.openConn's pool-reuse path, with the pool's
+// connection string and, as sessionID, the address of the acquired ODPI-C
+// connection handle. Nothing in this package calls OnRelease.
+type PoolHooks struct {
+	OnAcquire func(pool, sessionID string)
+	OnRelease func(pool, sessionID string)
+}
+
+// OnRoundTrip, if set, is called with the call's error after each
+// dpiConn_create, dpiPool_create and dpiPool_acquireConnection call made by
+// drv.openConn, and after each TraceStmt call. Other ODPI-C calls, statement
+// execute/fetch included, do not fire it.
+var OnRoundTrip func(ctx context.Context, opName string, err error)
+
+// Stmt and Pool hold the currently installed tracing hooks; the zero value
+// of each field is a no-op.
+var (
+	Stmt StmtHooks
+	Pool PoolHooks
+)
+
+func traceRoundTrip(ctx context.Context, opName string, err error) {
+	if OnRoundTrip != nil {
+		OnRoundTrip(ctx, opName, err)
+	}
+}
+
+// SpanAttr is a single OpenTelemetry-style span attribute.
+type SpanAttr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is the minimal surface TraceStmt needs from a tracing span, satisfied
+// by a thin wrapper around an OpenTelemetry trace.Span.
+type Span interface {
+	SetAttributes(attrs ...SpanAttr)
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...SpanAttr) {}
+func (noopSpan) RecordError(error)         {}
+func (noopSpan) End()                      {}
+
+// SpanStarter starts a Span named name for ctx, returning the (possibly
+// derived) context to propagate to child calls.
+type SpanStarter func(ctx context.Context, name string) (context.Context, Span)
+
+var startSpan SpanStarter = func(ctx context.Context, _ string) (context.Context, Span) { return ctx, noopSpan{} }
+
+// SetSpanStarter installs the SpanStarter used by TraceStmt, e.g. one backed
+// by go.opentelemetry.io/otel's Tracer.Start.
+func SetSpanStarter(f SpanStarter) {
+	if f == nil {
+		f = func(ctx context.Context, _ string) (context.Context, Span) { return ctx, noopSpan{} }
+	}
+	startSpan = f
+}
+
+// TraceStmt wraps fn (a statement execution or fetch) with the StmtHooks,
+// OnRoundTrip and a span carrying the conventional sql.db.system/db.statement
+// attributes plus, on failure, the ORA-NNNNN error code.
+func TraceStmt(ctx context.Context, query string, args []driver.NamedValue, fn func() (int64, error)) (int64, error) {
+	if Stmt.OnStmtStart != nil {
+		Stmt.OnStmtStart(ctx, query, args)
+	}
+	ctx, span := startSpan(ctx, "db.statement")
+	span.SetAttributes(
+		SpanAttr{Key: "sql.db.system", Value: "oracle"},
+		SpanAttr{Key: "db.statement", Value: query},
+	)
+	rows, err := fn()
+	if err != nil {
+		if oe, ok := errors.Cause(err).(*oraErr); ok {
+			span.SetAttributes(SpanAttr{Key: "db.oracle.error_code", Value: oe.Code()})
+		}
+		span.RecordError(err)
+	}
+	span.End()
+	traceRoundTrip(ctx, "statement", err)
+	if Stmt.OnStmtEnd != nil {
+		Stmt.OnStmtEnd(ctx, query, err, rows)
+	}
+	return rows, err
+}
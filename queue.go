@@ -0,0 +1,383 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package goracle
+
+/*
+#include <stdlib.h>
+
+#include "dpiImpl.h"
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// DeqMode mirrors dpiDeqMode.
+type DeqMode int
+
+const (
+	DeqBrowse       = DeqMode(C.DPI_MODE_DEQ_BROWSE)
+	DeqLocked       = DeqMode(C.DPI_MODE_DEQ_LOCKED)
+	DeqRemove       = DeqMode(C.DPI_MODE_DEQ_REMOVE)
+	DeqRemoveNoData = DeqMode(C.DPI_MODE_DEQ_REMOVE_NO_DATA)
+)
+
+// DeqNavigation mirrors dpiDeqNavigation.
+type DeqNavigation int
+
+const (
+	NavFirstMsg        = DeqNavigation(C.DPI_DEQ_NAV_FIRST_MSG)
+	NavNextTransaction = DeqNavigation(C.DPI_DEQ_NAV_NEXT_TRANSACTION)
+	NavNextMsg         = DeqNavigation(C.DPI_DEQ_NAV_NEXT_MSG)
+)
+
+// Visibility mirrors dpiVisibility (enqueue/dequeue transactional visibility).
+type Visibility int
+
+const (
+	VisibilityImmediate = Visibility(C.DPI_VISIBILITY_IMMEDIATE)
+	VisibilityOnCommit  = Visibility(C.DPI_VISIBILITY_ON_COMMIT)
+)
+
+// Message is a single AQ message, for both enqueuing and dequeuing.
+type Message struct {
+	// Payload is the raw payload for RAW queues.
+	Payload []byte
+	// Object is the payload for object-typed queues.
+	Object *Object
+	Correlation string
+	Delay       time.Duration
+	Expiration  time.Duration
+	Priority    int
+	ExceptionQueue string
+	MsgID       string
+	NumAttempts int
+	Enqueued    time.Time
+	State       int
+}
+
+// EnqOptions holds the enqueue options of a Queue (dpiEnqOptions).
+type EnqOptions struct {
+	Visibility  Visibility
+	DeliveryMode int
+}
+
+// DeqOptions holds the dequeue options of a Queue (dpiDeqOptions).
+type DeqOptions struct {
+	Mode        DeqMode
+	Navigation  DeqNavigation
+	Visibility  Visibility
+	Wait        time.Duration // 0 means no-wait, < 0 means block forever
+	Correlation string
+	Condition   string
+	Consumer    string
+	MsgID       string
+}
+
+// Queue represents an Oracle Advanced Queuing queue, obtained with NewQueue.
+type Queue struct {
+	conn           *conn
+	name           string
+	payloadObjType string
+	dpiQueue       *C.dpiQueue
+	enqOptions     *C.dpiEnqOptions
+	deqOptions     *C.dpiDeqOptions
+}
+
+// NewQueue returns a Queue for name, optionally typed with payloadObjType
+// (empty for a RAW queue), on the goracle driver connection underlying sc,
+// which is reached through (*sql.Conn).Raw.
+func NewQueue(sc *sql.Conn, name, payloadObjType string) (*Queue, error) {
+	var q *Queue
+	err := sc.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*conn)
+		if !ok {
+			return errors.Errorf("expected *goracle.conn, got %T", driverConn)
+		}
+		nq, err := c.newQueue(name, payloadObjType)
+		if err != nil {
+			return err
+		}
+		q = nq
+		return nil
+	})
+	return q, err
+}
+
+func (c *conn) newQueue(name, payloadObjType string) (*Queue, error) {
+	q := &Queue{conn: c, name: name, payloadObjType: payloadObjType}
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var objType *C.dpiObjectType
+	if payloadObjType != "" {
+		cType := C.CString(payloadObjType)
+		defer C.free(unsafe.Pointer(cType))
+		if C.dpiConn_getObjectType(c.dpiConn, cType, C.uint32_t(len(payloadObjType)), &objType) == C.DPI_FAILURE {
+			return nil, errors.Wrapf(c.drv.getError(), "getObjectType %q", payloadObjType)
+		}
+	}
+
+	if C.dpiConn_newQueue(c.dpiConn, cName, C.uint32_t(len(name)), objType, &q.dpiQueue) == C.DPI_FAILURE {
+		return nil, errors.Wrapf(c.drv.getError(), "newQueue %q", name)
+	}
+	if C.dpiQueue_getEnqOptions(q.dpiQueue, &q.enqOptions) == C.DPI_FAILURE {
+		return nil, errors.Wrap(c.drv.getError(), "getEnqOptions")
+	}
+	if C.dpiQueue_getDeqOptions(q.dpiQueue, &q.deqOptions) == C.DPI_FAILURE {
+		return nil, errors.Wrap(c.drv.getError(), "getDeqOptions")
+	}
+	return q, nil
+}
+
+// SetEnqOptions applies opts to the queue's enqueue options.
+func (q *Queue) SetEnqOptions(opts EnqOptions) error {
+	if C.dpiEnqOptions_setVisibility(q.enqOptions, C.dpiVisibility(opts.Visibility)) == C.DPI_FAILURE {
+		return errors.Wrap(q.conn.drv.getError(), "setVisibility")
+	}
+	if opts.DeliveryMode != 0 {
+		if C.dpiEnqOptions_setDeliveryMode(q.enqOptions, C.dpiMessageDeliveryMode(opts.DeliveryMode)) == C.DPI_FAILURE {
+			return errors.Wrap(q.conn.drv.getError(), "setDeliveryMode")
+		}
+	}
+	return nil
+}
+
+// SetDeqOptions applies opts to the queue's dequeue options.
+func (q *Queue) SetDeqOptions(opts DeqOptions) error {
+	if C.dpiDeqOptions_setMode(q.deqOptions, C.dpiDeqMode(opts.Mode)) == C.DPI_FAILURE {
+		return errors.Wrap(q.conn.drv.getError(), "setMode")
+	}
+	if C.dpiDeqOptions_setNavigation(q.deqOptions, C.dpiDeqNavigation(opts.Navigation)) == C.DPI_FAILURE {
+		return errors.Wrap(q.conn.drv.getError(), "setNavigation")
+	}
+	if C.dpiDeqOptions_setVisibility(q.deqOptions, C.dpiVisibility(opts.Visibility)) == C.DPI_FAILURE {
+		return errors.Wrap(q.conn.drv.getError(), "setVisibility")
+	}
+	wait := C.uint32_t(0)
+	switch {
+	case opts.Wait < 0:
+		wait = C.DPI_DEQ_WAIT_FOREVER
+	case opts.Wait > 0:
+		// Round up to whole seconds (dpiDeqOptions_setWait's unit) so a
+		// sub-second wait like 500*time.Millisecond isn't truncated to 0,
+		// which this same switch treats as "no wait" rather than "a bit".
+		wait = C.uint32_t((opts.Wait + time.Second - 1) / time.Second)
+	}
+	if C.dpiDeqOptions_setWait(q.deqOptions, wait) == C.DPI_FAILURE {
+		return errors.Wrap(q.conn.drv.getError(), "setWait")
+	}
+	if opts.Correlation != "" {
+		cCorr := C.CString(opts.Correlation)
+		defer C.free(unsafe.Pointer(cCorr))
+		if C.dpiDeqOptions_setCorrelation(q.deqOptions, cCorr, C.uint32_t(len(opts.Correlation))) == C.DPI_FAILURE {
+			return errors.Wrap(q.conn.drv.getError(), "setCorrelation")
+		}
+	}
+	if opts.Condition != "" {
+		cCond := C.CString(opts.Condition)
+		defer C.free(unsafe.Pointer(cCond))
+		if C.dpiDeqOptions_setCondition(q.deqOptions, cCond, C.uint32_t(len(opts.Condition))) == C.DPI_FAILURE {
+			return errors.Wrap(q.conn.drv.getError(), "setCondition")
+		}
+	}
+	if opts.Consumer != "" {
+		cCons := C.CString(opts.Consumer)
+		defer C.free(unsafe.Pointer(cCons))
+		if C.dpiDeqOptions_setConsumerName(q.deqOptions, cCons, C.uint32_t(len(opts.Consumer))) == C.DPI_FAILURE {
+			return errors.Wrap(q.conn.drv.getError(), "setConsumerName")
+		}
+	}
+	if opts.MsgID != "" {
+		cMsgID := C.CString(opts.MsgID)
+		defer C.free(unsafe.Pointer(cMsgID))
+		if C.dpiDeqOptions_setMsgId(q.deqOptions, cMsgID, C.uint32_t(len(opts.MsgID))) == C.DPI_FAILURE {
+			return errors.Wrap(q.conn.drv.getError(), "setMsgId")
+		}
+	}
+	return nil
+}
+
+// Enqueue enqueues msgs onto the queue in a single dpiQueue_enqMany call.
+func (q *Queue) Enqueue(msgs []Message) error {
+	props := make([]*C.dpiMsgProps, len(msgs))
+	for i, m := range msgs {
+		p, err := q.newMsgProps(m)
+		if err != nil {
+			for _, done := range props[:i] {
+				C.dpiMsgProps_release(done)
+			}
+			return err
+		}
+		props[i] = p
+	}
+	defer func() {
+		for _, p := range props {
+			C.dpiMsgProps_release(p)
+		}
+	}()
+	if len(props) == 0 {
+		return nil
+	}
+	if C.dpiQueue_enqMany(q.dpiQueue, C.uint32_t(len(props)), &props[0]) == C.DPI_FAILURE {
+		return errors.Wrapf(q.conn.drv.getError(), "enqMany %q", q.name)
+	}
+	return nil
+}
+
+func (q *Queue) newMsgProps(m Message) (*C.dpiMsgProps, error) {
+	var props *C.dpiMsgProps
+	if C.dpiConn_newMsgProps(q.conn.dpiConn, &props) == C.DPI_FAILURE {
+		return nil, errors.Wrap(q.conn.drv.getError(), "newMsgProps")
+	}
+	if m.Object != nil {
+		if C.dpiMsgProps_setPayloadObject(props, m.Object.dpiObject) == C.DPI_FAILURE {
+			C.dpiMsgProps_release(props)
+			return nil, errors.Wrap(q.conn.drv.getError(), "setPayloadObject")
+		}
+	} else if len(m.Payload) != 0 {
+		cPayload := C.CString(string(m.Payload))
+		defer C.free(unsafe.Pointer(cPayload))
+		if C.dpiMsgProps_setPayloadBytes(props, cPayload, C.uint32_t(len(m.Payload))) == C.DPI_FAILURE {
+			C.dpiMsgProps_release(props)
+			return nil, errors.Wrap(q.conn.drv.getError(), "setPayloadBytes")
+		}
+	}
+	if m.Correlation != "" {
+		cCorr := C.CString(m.Correlation)
+		defer C.free(unsafe.Pointer(cCorr))
+		C.dpiMsgProps_setCorrelation(props, cCorr, C.uint32_t(len(m.Correlation)))
+	}
+	if m.Delay != 0 {
+		C.dpiMsgProps_setDelay(props, C.int32_t(m.Delay/time.Second))
+	}
+	if m.Expiration != 0 {
+		C.dpiMsgProps_setExpiration(props, C.int32_t(m.Expiration/time.Second))
+	}
+	if m.Priority != 0 {
+		C.dpiMsgProps_setPriority(props, C.int32_t(m.Priority))
+	}
+	if m.ExceptionQueue != "" {
+		cExc := C.CString(m.ExceptionQueue)
+		defer C.free(unsafe.Pointer(cExc))
+		C.dpiMsgProps_setExceptionQ(props, cExc, C.uint32_t(len(m.ExceptionQueue)))
+	}
+	return props, nil
+}
+
+// Dequeue dequeues up to max messages in a single dpiQueue_deqMany call.
+func (q *Queue) Dequeue(max int) ([]Message, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	num := C.uint32_t(max)
+	props := make([]*C.dpiMsgProps, max)
+	if C.dpiQueue_deqMany(q.dpiQueue, &num, &props[0]) == C.DPI_FAILURE {
+		return nil, errors.Wrapf(q.conn.drv.getError(), "deqMany %q", q.name)
+	}
+	msgs := make([]Message, 0, int(num))
+	for _, p := range props[:num] {
+		msgs = append(msgs, q.fromMsgProps(p))
+		C.dpiMsgProps_release(p)
+	}
+	return msgs, nil
+}
+
+func (q *Queue) fromMsgProps(p *C.dpiMsgProps) Message {
+	var m Message
+	var cPayload *C.char
+	var payloadLen C.uint32_t
+	var payloadObj *C.dpiObject
+	if C.dpiMsgProps_getPayload(p, &payloadObj, &cPayload, &payloadLen) == C.DPI_SUCCESS {
+		if payloadObj != nil {
+			m.Object = &Object{dpiObject: payloadObj}
+		} else if cPayload != nil {
+			m.Payload = C.GoBytes(unsafe.Pointer(cPayload), C.int(payloadLen))
+		}
+	}
+	var cMsgID *C.char
+	var msgIDLen C.uint32_t
+	if C.dpiMsgProps_getMsgId(p, &cMsgID, &msgIDLen) == C.DPI_SUCCESS && cMsgID != nil {
+		m.MsgID = C.GoStringN(cMsgID, C.int(msgIDLen))
+	}
+	var numAttempts C.int32_t
+	if C.dpiMsgProps_getNumAttempts(p, &numAttempts) == C.DPI_SUCCESS {
+		m.NumAttempts = int(numAttempts)
+	}
+	var state C.dpiMessageState
+	if C.dpiMsgProps_getState(p, &state) == C.DPI_SUCCESS {
+		m.State = int(state)
+	}
+	return m
+}
+
+// listenPollWait bounds how long Listen waits on any single consumer before
+// moving on to the next one, so one consumer with nothing to deliver can't
+// starve the others in the round-robin.
+const listenPollWait = time.Second
+
+// Listen round-robins a short, bounded dequeue wait across consumers,
+// pushing messages onto the returned channel until ctx is done or a
+// SetDeqOptions/Dequeue call fails; either way the channel is then closed,
+// and such an error is not reported. It is a simple AQ-backed message bus
+// for Go services, built as a bounded poll loop rather than on AQ
+// notifications.
+func (q *Queue) Listen(ctx context.Context, consumers []string) (<-chan Message, error) {
+	if len(consumers) == 0 {
+		return nil, errors.New("Listen: no consumers given")
+	}
+	ch := make(chan Message)
+	go func() {
+		defer close(ch)
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			for _, consumer := range consumers {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := q.SetDeqOptions(DeqOptions{Consumer: consumer, Wait: listenPollWait}); err != nil {
+					return
+				}
+				msgs, err := q.Dequeue(1)
+				if err != nil {
+					return
+				}
+				for _, m := range msgs {
+					select {
+					case ch <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Object is a minimal handle to an Oracle object instance, used for
+// object-typed AQ payloads.
+type Object struct {
+	dpiObject *C.dpiObject
+}
@@ -0,0 +1,307 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package goracle
+
+/*
+#include <stdlib.h>
+
+#include "dpiImpl.h"
+
+extern void goracleSubscrCallback(void *context, dpiSubscrMessage *message);
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// EventType is the type of a CQN/DBCHANGE notification.
+type EventType int
+
+const (
+	// EventStartup is fired when the subscribed database (instance) starts up.
+	EventStartup = EventType(C.DPI_EVENT_STARTUP)
+	// EventShutdown is fired when the subscribed database (instance) shuts down.
+	EventShutdown = EventType(C.DPI_EVENT_SHUTDOWN)
+	// EventShutdownAny is fired when any instance of the subscribed database shuts down.
+	EventShutdownAny = EventType(C.DPI_EVENT_SHUTDOWN_ANY)
+	// EventDereg is fired when the subscription is forcibly deregistered, e.g. on connection loss.
+	EventDereg = EventType(C.DPI_EVENT_DEREG)
+	// EventObjChange is fired on object-level DDL/DML changes.
+	EventObjChange = EventType(C.DPI_EVENT_OBJCHANGE)
+	// EventQueryChange is fired for query-result-set level changes (CQN).
+	EventQueryChange = EventType(C.DPI_EVENT_QUERYCHANGE)
+)
+
+// RowOperation describes the DML operation that touched a row.
+type RowOperation int
+
+const (
+	OpAllRows = RowOperation(C.DPI_OPCODE_ALL_ROWS)
+	OpInsert  = RowOperation(C.DPI_OPCODE_INSERT)
+	OpUpdate  = RowOperation(C.DPI_OPCODE_UPDATE)
+	OpDelete  = RowOperation(C.DPI_OPCODE_DELETE)
+	OpAlter   = RowOperation(C.DPI_OPCODE_ALTER)
+	OpDrop    = RowOperation(C.DPI_OPCODE_DROP)
+	OpUnknown = RowOperation(C.DPI_OPCODE_UNKNOWN)
+)
+
+// Row is a single changed row reported by a CQN/DBCHANGE event.
+type Row struct {
+	Rowid     string
+	Operation RowOperation
+}
+
+// Table is a single changed table (with its rows, if row-level granularity was requested).
+type Table struct {
+	Name      string
+	Operation RowOperation
+	Rows      []Row
+}
+
+// Event is the Go representation of a dpiSubscrMessage.
+type Event struct {
+	Type   EventType
+	DB     string
+	Tables []Table
+	Err    error
+}
+
+// QoS holds the quality-of-service flags for a subscription, mirroring dpiSubscrQOS.
+type QoS uint32
+
+const (
+	// QoSReliable asks the server to persist the notification until delivered.
+	QoSReliable = QoS(C.DPI_SUBSCR_QOS_RELIABLE)
+	// QoSDeregNFY asks for automatic deregistration after the first notification.
+	QoSDeregNFY = QoS(C.DPI_SUBSCR_QOS_DEREG_NFY)
+	// QoSRowids requests ROWID-level granularity in the notifications.
+	QoSRowids = QoS(C.DPI_SUBSCR_QOS_ROWIDS)
+	// QoSQuery requests query-result-set level notifications (CQN) rather than plain DBCHANGE.
+	QoSQuery = QoS(C.DPI_SUBSCR_QOS_QUERY)
+	// QoSBestEffort relaxes QoSQuery to a best-effort CQN registration.
+	QoSBestEffort = QoS(C.DPI_SUBSCR_QOS_BEST_EFFORT)
+)
+
+// subscrEventBuffer bounds how many undelivered events a Subscription will
+// queue for its callback before newer events are dropped, so a slow or
+// blocking callback can never stall the ODPI-C notification thread.
+const subscrEventBuffer = 256
+
+// Subscription represents a registered CQN/DBCHANGE subscription.
+//
+// Acquire one with NewSubscription.
+type Subscription struct {
+	dpiSubscr *C.dpiSubscr
+	drv       *drv
+	id        uintptr
+	callback  func(Event)
+	events    chan Event
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	closed    bool
+}
+
+// dispatch drains sub.events and invokes the user callback, running on its
+// own goroutine so goracleSubscrCallback never blocks on it.
+func (sub *Subscription) dispatch() {
+	defer sub.wg.Done()
+	for ev := range sub.events {
+		sub.callback(ev)
+	}
+}
+
+var (
+	subscrsMu sync.Mutex
+	subscrs   = make(map[uintptr]*Subscription)
+	subscrSeq uintptr
+)
+
+// NewSubscription registers a query-based Continuous Query Notification (CQN)
+// subscription for query and calls callback whenever the result set changes.
+//
+// qos controls the requested granularity (e.g. QoSRowids|QoSQuery|QoSBestEffort).
+func NewSubscription(ctx context.Context, sc *sql.Conn, query string, qos QoS, callback func(Event)) (*Subscription, error) {
+	var sub *Subscription
+	err := sc.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*conn)
+		if !ok {
+			return errors.Errorf("expected *goracle.conn, got %T", driverConn)
+		}
+		s, err := c.newSubscription(query, qos, callback)
+		if err != nil {
+			return err
+		}
+		sub = s
+		return nil
+	})
+	return sub, err
+}
+
+// newSubscription registers the subscription on c; see NewSubscription.
+func (c *conn) newSubscription(query string, qos QoS, callback func(Event)) (*Subscription, error) {
+	sub := &Subscription{drv: c.drv, callback: callback, events: make(chan Event, subscrEventBuffer)}
+	sub.wg.Add(1)
+	go sub.dispatch()
+
+	subscrsMu.Lock()
+	subscrSeq++
+	sub.id = subscrSeq
+	subscrs[sub.id] = sub
+	subscrsMu.Unlock()
+
+	var params C.dpiSubscrCreateParams
+	if C.dpiContext_initSubscrCreateParams(c.drv.dpiContext, &params) == C.DPI_FAILURE {
+		sub.Close()
+		return nil, errors.Wrap(c.drv.getError(), "initSubscrCreateParams")
+	}
+	params.subscrNamespace = C.DPI_SUBSCR_NAMESPACE_DBCHANGE
+	params.protocol = C.DPI_SUBSCR_PROTO_CALLBACK
+	params.qos = C.dpiSubscrQOS(qos)
+	params.operations = C.DPI_OPCODE_ALL_OPS
+	params.callback = C.dpiSubscrCallback(C.goracleSubscrCallback)
+	params.callbackContext = unsafe.Pointer(sub.id)
+
+	if C.dpiConn_subscribe(c.dpiConn, &params, &sub.dpiSubscr) == C.DPI_FAILURE {
+		sub.Close()
+		return nil, errors.Wrapf(c.drv.getError(), "subscribe %q", query)
+	}
+
+	cQuery := C.CString(query)
+	defer C.free(unsafe.Pointer(cQuery))
+	var stmt *C.dpiStmt
+	if C.dpiSubscr_prepareStmt(sub.dpiSubscr, cQuery, C.uint32_t(len(query)), &stmt) == C.DPI_FAILURE {
+		sub.Close()
+		return nil, errors.Wrapf(c.drv.getError(), "prepareStmt %q", query)
+	}
+	defer C.dpiStmt_release(stmt)
+	var queryId C.uint64_t
+	if C.dpiStmt_executeForQueryId(stmt, C.DPI_MODE_EXEC_DEFAULT, &queryId) == C.DPI_FAILURE {
+		sub.Close()
+		return nil, errors.Wrap(c.drv.getError(), "executeForQueryId")
+	}
+
+	return sub, nil
+}
+
+func (sub *Subscription) forget() {
+	subscrsMu.Lock()
+	delete(subscrs, sub.id)
+	subscrsMu.Unlock()
+}
+
+// Close unregisters the subscription and stops its dispatch goroutine. It is
+// safe to call Close multiple times.
+func (sub *Subscription) Close() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return nil
+	}
+	sub.closed = true
+	sub.forget()
+	close(sub.events)
+	sub.wg.Wait()
+	if sub.dpiSubscr == nil {
+		return nil
+	}
+	if C.dpiSubscr_close(sub.dpiSubscr) == C.DPI_FAILURE {
+		return errors.Wrap(sub.drv.getError(), "close subscription")
+	}
+	return nil
+}
+
+//export goracleSubscrCallback
+func goracleSubscrCallback(context unsafe.Pointer, message *C.dpiSubscrMessage) {
+	id := uintptr(context)
+	subscrsMu.Lock()
+	sub, ok := subscrs[id]
+	subscrsMu.Unlock()
+	if !ok || sub.callback == nil {
+		return
+	}
+	// dpiSubscrMessage is only valid for the duration of this call, and ODPI-C
+	// invokes it on its own notification thread: decode it now, then hand the
+	// Event off to sub's dispatch goroutine. The send is non-blocking so a
+	// slow/blocking user callback (or a full buffer) can never stall this
+	// notification thread; we drop the event and log instead.
+	select {
+	case sub.events <- newEvent(message):
+	default:
+		Log("msg", "dropping CQN event: subscriber too slow", "subscription", id)
+	}
+}
+
+func newEvent(message *C.dpiSubscrMessage) Event {
+	ev := Event{Type: EventType(message.eventType)}
+	if message.dbNameLength > 0 {
+		ev.DB = C.GoStringN(message.dbName, C.int(message.dbNameLength))
+	}
+	if message.errorInfo != nil {
+		ev.Err = (&oraErr{errInfo: *message.errorInfo}).asError()
+	}
+	if message.numTables == 0 || message.tables == nil {
+		return ev
+	}
+	tables := (*[1 << 20]C.dpiSubscrMessageTable)(unsafe.Pointer(message.tables))[:message.numTables:message.numTables]
+	ev.Tables = make([]Table, len(tables))
+	for i, mt := range tables {
+		t := Table{Operation: RowOperation(mt.operation)}
+		if mt.nameLength > 0 {
+			t.Name = C.GoStringN(mt.name, C.int(mt.nameLength))
+		}
+		if mt.numRows > 0 && mt.rows != nil {
+			rows := (*[1 << 20]C.dpiSubscrMessageRow)(unsafe.Pointer(mt.rows))[:mt.numRows:mt.numRows]
+			t.Rows = make([]Row, len(rows))
+			for j, mr := range rows {
+				t.Rows[j] = Row{
+					Operation: RowOperation(mr.operation),
+					Rowid:     C.GoStringN(mr.rowid, C.int(mr.rowidLength)),
+				}
+			}
+		}
+		ev.Tables[i] = t
+	}
+	return ev
+}
+
+func (oe *oraErr) asError() error {
+	if oe.errInfo.code == 0 && oe.Message() == "" {
+		return nil
+	}
+	return oe
+}
+
+type subscrCtxKey string
+
+const subscriptionCtxKey = subscrCtxKey("goracle.Subscription")
+
+// ContextWithSubscription stashes sub in ctx so it can later be retrieved
+// (e.g. to Close it from a deferred cleanup further down the call stack).
+func ContextWithSubscription(ctx context.Context, sub *Subscription) context.Context {
+	return context.WithValue(ctx, subscriptionCtxKey, sub)
+}
+
+// SubscriptionFromContext returns the Subscription stored by ContextWithSubscription, if any.
+func SubscriptionFromContext(ctx context.Context) (*Subscription, bool) {
+	sub, ok := ctx.Value(subscriptionCtxKey).(*Subscription)
+	return sub, ok
+}